@@ -17,9 +17,11 @@ package collector
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
@@ -33,39 +35,268 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+// urlAcceptHeader is sent with every collector.textfile.url fetch,
+// requesting the classic Prometheus text format, which is all this
+// collector's parser understands.
+const urlAcceptHeader = `text/plain;version=0.0.4;q=1,*/*;q=0.1`
+
 var (
-	textFileDirectory = kingpin.Flag(
+	textFileDirectories = kingpin.Flag(
 		"collector.textfile.directory",
-		"Directory to read text files with metrics from.",
-	).Default("C:\\Program Files\\wmi_exporter\\textfile_inputs").String()
-
+		"Directory to read text files with metrics from. Can be specified multiple times.",
+	).Default("C:\\Program Files\\wmi_exporter\\textfile_inputs").Strings()
+
+	textFileRecursive = kingpin.Flag(
+		"collector.textfile.recursive",
+		"Scan the textfile directories recursively for files, rather than only the top level.",
+	).Default("false").Bool()
+
+	textFileMaxAge = kingpin.Flag(
+		"collector.textfile.max-age",
+		"Textfiles whose mtime is older than this are considered stale: their metrics are suppressed but wmi_textfile_scrape_error still reports them. Zero disables the check.",
+	).Default("0s").Duration()
+
+	textFileURLs = kingpin.Flag(
+		"collector.textfile.url",
+		"HTTP(S) URL to fetch metrics in exposition format from on every scrape, in addition to collector.textfile.directory. Can be specified multiple times.",
+	).Strings()
+
+	textFileURLTimeout = kingpin.Flag(
+		"collector.textfile.url-timeout",
+		"Timeout for fetching metrics from collector.textfile.url sources.",
+	).Default("5s").Duration()
+
+	// mtimeDesc reports the mtime of every source successfully read, and of
+	// every file skipped as stale past collector.textfile.max-age: a file's
+	// on-disk ModTime, or the fetch time for a collector.textfile.url
+	// source, which has no mtime of its own.
 	mtimeDesc = prometheus.NewDesc(
 		"wmi_textfile_mtime_seconds",
 		"Unixtime mtime of textfiles successfully read.",
-		[]string{"file"},
+		[]string{"source"},
+		nil,
+	)
+
+	// scrapeErrorDesc is reported once per source - a file or a
+	// collector.textfile.url URL (0 = ok, 1 = open/fetch/parse error, 2 =
+	// a file stale past collector.textfile.max-age) - and once more with
+	// an empty "source" label as the aggregate across all of them. This
+	// aggregate row is no longer label-identical to the unlabeled metric
+	// this collector reported before collector.textfile.max-age was added:
+	// it now carries an empty "source" label like every other row, rather
+	// than no labels at all.
+	scrapeErrorDesc = prometheus.NewDesc(
+		"wmi_textfile_scrape_error",
+		"1 if there was an error opening, reading or fetching a source, 2 if a file is stale past collector.textfile.max-age, 0 otherwise",
+		[]string{"source"},
 		nil,
 	)
 )
 
 type textFileCollector struct {
-	path string
+	paths      []string
+	recursive  bool
+	maxAge     time.Duration
+	urls       []string
+	httpClient *http.Client
 	// Only set for testing to get predictable output.
 	mtime *float64
 }
 
+// textFileEntry identifies a single discovered textfile, along with the
+// label under which it should be reported.
+type textFileEntry struct {
+	fullPath string
+	// relPath is fullPath relative to the directory it was discovered under,
+	// using forward slashes, so files with the same name in different
+	// directories don't collide in the "source" label.
+	relPath string
+	modTime time.Time
+}
+
 func init() {
 	Factories["textfile"] = NewTextFileCollector
 }
 
-// NewTextFileCollector returns a new Collector exposing metrics read from files
-// in the given textfile directory.
+// NewTextFileCollector returns a new Collector exposing metrics read from
+// files in the given textfile directories and, if configured, fetched from
+// collector.textfile.url sources.
 func NewTextFileCollector() (Collector, error) {
 	return &textFileCollector{
-		path: *textFileDirectory,
+		paths:      *textFileDirectories,
+		recursive:  *textFileRecursive,
+		maxAge:     *textFileMaxAge,
+		urls:       *textFileURLs,
+		httpClient: &http.Client{Timeout: *textFileURLTimeout},
 	}, nil
 }
 
-func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Metric, seen map[uint64]string, path string) {
+// discoverFiles walks c.paths (recursively, if c.recursive is set) and
+// returns every file found. Errors encountered reading or walking an
+// individual directory are logged and reported via the bool return value,
+// but do not stop discovery in the remaining directories.
+func (c *textFileCollector) discoverFiles() ([]textFileEntry, bool) {
+	var entries []textFileEntry
+	hadError := false
+
+	for _, root := range c.paths {
+		if root == "" {
+			continue
+		}
+
+		if c.recursive {
+			err := filepath.Walk(root, func(p string, info os.FileInfo, walkErr error) error {
+				if walkErr != nil {
+					return walkErr
+				}
+				if info.IsDir() {
+					return nil
+				}
+				rel, relErr := filepath.Rel(root, p)
+				if relErr != nil {
+					rel = info.Name()
+				}
+				entries = append(entries, textFileEntry{
+					fullPath: p,
+					relPath:  filepath.ToSlash(rel),
+					modTime:  info.ModTime(),
+				})
+				return nil
+			})
+			if err != nil {
+				log.Errorf("Error walking textfile collector directory %q: %s", root, err)
+				hadError = true
+			}
+			continue
+		}
+
+		files, err := ioutil.ReadDir(root)
+		if err != nil {
+			log.Errorf("Error reading textfile collector directory %q: %s", root, err)
+			hadError = true
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			entries = append(entries, textFileEntry{
+				fullPath: filepath.Join(root, f.Name()),
+				relPath:  filepath.ToSlash(f.Name()),
+				modTime:  f.ModTime(),
+			})
+		}
+	}
+
+	return entries, hadError
+}
+
+// fetchURL fetches url and parses the body as classic Prometheus text.
+func (c *textFileCollector) fetchURL(url string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", urlAcceptHeader)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(carriageReturnFilteringReader{r: resp.Body})
+}
+
+// familyAggregate accumulates the metrics contributed to a single metric
+// family by every textfile that reports it, so that cooperating files can
+// split a family across files rather than needing to own it outright.
+type familyAggregate struct {
+	family *dto.MetricFamily
+	// seenAt maps a metric's (family, label-set) hash to the path it was
+	// first observed in, so a genuine conflict can name both files.
+	seenAt map[uint64]string
+	// metricByHash holds the metric kept for each hash in seenAt, so a
+	// later sample with the same label-set can be compared against it.
+	metricByHash map[uint64]*dto.Metric
+}
+
+func newFamilyAggregate(mf *dto.MetricFamily) *familyAggregate {
+	return &familyAggregate{
+		family: &dto.MetricFamily{
+			Name: mf.Name,
+			Help: mf.Help,
+			Type: mf.Type,
+		},
+		seenAt:       map[uint64]string{},
+		metricByHash: map[uint64]*dto.Metric{},
+	}
+}
+
+// addFamily merges mf's metrics, read from path, into the aggregate. A
+// metric whose (family, label-set) hash was already collected from another
+// file is only dropped silently if it agrees with the one already kept;
+// disagreement is a real conflict and is logged rather than merged.
+func (a *familyAggregate) addFamily(mf *dto.MetricFamily, path string) {
+	if a.family.GetType() != mf.GetType() {
+		log.Errorf("Metric family %q has type %s from an earlier file but %s from %s, ignoring that file's contribution", mf.GetName(), a.family.GetType(), mf.GetType(), path)
+		return
+	}
+	if a.family.Help == nil && mf.Help != nil {
+		a.family.Help = mf.Help
+	}
+
+	for _, m := range mf.Metric {
+		h := hash(mf, m)
+		if seenIn, ok := a.seenAt[h]; ok {
+			if !metricValuesEqual(a.family.GetType(), a.metricByHash[h], m) {
+				names, values := labelNamesAndValues(m)
+				repr := friendlyString(mf.GetName(), names, values)
+				log.Errorf("Metric %s was read from %s, but conflicts with the value already collected from %s, skipping", repr, path, seenIn)
+			}
+			continue
+		}
+		a.seenAt[h] = path
+		a.metricByHash[h] = m
+		a.family.Metric = append(a.family.Metric, m)
+	}
+}
+
+// metricValuesEqual reports whether two metrics of the given type carry the
+// same value, so a duplicate sample can be distinguished from a conflict.
+func metricValuesEqual(t dto.MetricType, a, b *dto.Metric) bool {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return a.Counter.GetValue() == b.Counter.GetValue()
+	case dto.MetricType_GAUGE:
+		return a.Gauge.GetValue() == b.Gauge.GetValue()
+	case dto.MetricType_UNTYPED:
+		return a.Untyped.GetValue() == b.Untyped.GetValue()
+	case dto.MetricType_SUMMARY:
+		return a.Summary.GetSampleCount() == b.Summary.GetSampleCount() &&
+			a.Summary.GetSampleSum() == b.Summary.GetSampleSum()
+	case dto.MetricType_HISTOGRAM:
+		return a.Histogram.GetSampleCount() == b.Histogram.GetSampleCount() &&
+			a.Histogram.GetSampleSum() == b.Histogram.GetSampleSum()
+	default:
+		return false
+	}
+}
+
+func labelNamesAndValues(m *dto.Metric) (names, values []string) {
+	for _, label := range m.GetLabel() {
+		names = append(names, label.GetName())
+		values = append(values, label.GetValue())
+	}
+	return names, values
+}
+
+func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Metric) {
 	var valType prometheus.ValueType
 	var val float64
 
@@ -106,14 +337,6 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 			}
 		}
 
-		h := hash(metricFamily, metric)
-		if seenIn, ok := seen[h]; ok {
-			repr := friendlyString(*metricFamily.Name, names, values)
-			log.Warnf("Metric %s was read from %s, but has already been collected from file %s, skipping", repr, path, seenIn)
-			continue
-		}
-		seen[h] = path
-
 		metricType := metricFamily.GetType()
 		switch metricType {
 		case dto.MetricType_COUNTER:
@@ -195,45 +418,107 @@ func (c *textFileCollector) exportMTimes(mtimes map[string]time.Time, ch chan<-
 	}
 }
 
+// exportScrapeErrors reports the error code for every file and
+// collector.textfile.url source that was attempted, plus one aggregate row
+// (an empty "source" label) derived from them and from any error reading a
+// textfile directory. fileErrors and urlErrors
+// share the "source" label dimension, so they're exported through the same
+// Desc.
+func (c *textFileCollector) exportScrapeErrors(fileErrors, urlErrors map[string]float64, aggregateError float64, ch chan<- prometheus.Metric) {
+	sources := make([]string, 0, len(fileErrors)+len(urlErrors))
+	for source := range fileErrors {
+		sources = append(sources, source)
+	}
+	for source := range urlErrors {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		value, ok := fileErrors[source]
+		if !ok {
+			value = urlErrors[source]
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, value, source)
+	}
+
+	ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, aggregateError, "")
+}
+
 // Update implements the Collector interface.
 func (c *textFileCollector) Collect(ch chan<- prometheus.Metric) error {
-	error := 0.0
 	mtimes := map[string]time.Time{}
-	seenMetrics := make(map[uint64]string)
+	fileErrors := map[string]float64{}
+	urlErrors := map[string]float64{}
+	aggregates := map[string]*familyAggregate{}
+	var familyOrder []string
+	aggregateError := 0.0
 
 	// Iterate over files and accumulate their metrics.
-	files, err := ioutil.ReadDir(c.path)
-	if err != nil && c.path != "" {
-		log.Errorf("Error reading textfile collector directory %q: %s", c.path, err)
-		error = 1.0
+	entries, hadError := c.discoverFiles()
+	if hadError {
+		aggregateError = 1.0
 	}
 
+	now := time.Now()
+
 fileLoop:
-	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), ".prom") {
+	for _, entry := range entries {
+		isGzip := strings.HasSuffix(entry.fullPath, ".prom.gz")
+		if !strings.HasSuffix(entry.fullPath, ".prom") && !isGzip {
 			continue
 		}
-		path := filepath.Join(c.path, f.Name())
+		path := entry.fullPath
+
+		if c.maxAge > 0 && now.Sub(entry.modTime) > c.maxAge {
+			log.Warnf("Textfile %q is older than %s, suppressing its metrics", path, c.maxAge)
+			mtimes[entry.relPath] = entry.modTime
+			fileErrors[entry.relPath] = 2.0
+			aggregateError = 1.0
+			continue
+		}
+
 		log.Debugf("Processing file %q", path)
 		file, err := os.Open(path)
 		if err != nil {
 			log.Errorf("Error opening %q: %v", path, err)
-			error = 1.0
+			fileErrors[entry.relPath] = 1.0
+			aggregateError = 1.0
 			continue
 		}
+
+		src := io.Reader(file)
+		var gz *gzip.Reader
+		if isGzip {
+			gz, err = gzip.NewReader(file)
+			if err != nil {
+				log.Errorf("Error decompressing %q: %v", path, err)
+				file.Close()
+				fileErrors[entry.relPath] = 1.0
+				aggregateError = 1.0
+				continue
+			}
+			src = gz
+		}
+
 		var parser expfmt.TextParser
-		parsedFamilies, err := parser.TextToMetricFamilies(carriageReturnFilteringReader{r: file})
+		parsedFamilies, err := parser.TextToMetricFamilies(carriageReturnFilteringReader{r: src})
+		if gz != nil {
+			gz.Close()
+		}
 		file.Close()
 		if err != nil {
 			log.Errorf("Error parsing %q: %v", path, err)
-			error = 1.0
+			fileErrors[entry.relPath] = 1.0
+			aggregateError = 1.0
 			continue
 		}
 		for _, mf := range parsedFamilies {
 			for _, m := range mf.Metric {
 				if m.TimestampMs != nil {
 					log.Errorf("Textfile %q contains unsupported client-side timestamps, skipping entire file", path)
-					error = 1.0
+					fileErrors[entry.relPath] = 1.0
+					aggregateError = 1.0
 					continue fileLoop
 				}
 			}
@@ -245,24 +530,72 @@ fileLoop:
 
 		// Only set this once it has been parsed and validated, so that
 		// a failure does not appear fresh.
-		mtimes[f.Name()] = f.ModTime()
+		mtimes[entry.relPath] = entry.modTime
+		fileErrors[entry.relPath] = 0.0
+
+		for _, mf := range parsedFamilies {
+			agg, ok := aggregates[mf.GetName()]
+			if !ok {
+				agg = newFamilyAggregate(mf)
+				aggregates[mf.GetName()] = agg
+				familyOrder = append(familyOrder, mf.GetName())
+			}
+			agg.addFamily(mf, path)
+		}
+	}
+
+urlLoop:
+	for _, url := range c.urls {
+		if url == "" {
+			continue
+		}
+		log.Debugf("Fetching %q", url)
+		parsedFamilies, err := c.fetchURL(url)
+		if err != nil {
+			log.Errorf("Error fetching %q: %v", url, err)
+			urlErrors[url] = 1.0
+			aggregateError = 1.0
+			continue
+		}
+
+		for _, mf := range parsedFamilies {
+			for _, m := range mf.Metric {
+				if m.TimestampMs != nil {
+					log.Errorf("URL %q contains unsupported client-side timestamps, skipping entire source", url)
+					urlErrors[url] = 1.0
+					aggregateError = 1.0
+					continue urlLoop
+				}
+			}
+			if mf.Help == nil {
+				help := fmt.Sprintf("Metric read from %s", url)
+				mf.Help = &help
+			}
+		}
+
+		// Only set this once it has been parsed and validated, so that
+		// a failure does not appear fresh.
+		mtimes[url] = now
+		urlErrors[url] = 0.0
 
 		for _, mf := range parsedFamilies {
-			convertMetricFamily(mf, ch, seenMetrics, path)
+			agg, ok := aggregates[mf.GetName()]
+			if !ok {
+				agg = newFamilyAggregate(mf)
+				aggregates[mf.GetName()] = agg
+				familyOrder = append(familyOrder, mf.GetName())
+			}
+			agg.addFamily(mf, url)
 		}
 	}
 
+	for _, name := range familyOrder {
+		convertMetricFamily(aggregates[name].family, ch)
+	}
+
 	c.exportMTimes(mtimes, ch)
+	c.exportScrapeErrors(fileErrors, urlErrors, aggregateError, ch)
 
-	// Export if there were errors.
-	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc(
-			"wmi_textfile_scrape_error",
-			"1 if there was an error opening or reading a file, 0 otherwise",
-			nil, nil,
-		),
-		prometheus.GaugeValue, error,
-	)
 	return nil
 }
 
@@ -0,0 +1,264 @@
+// Below code originally copied from prometheus/node_exporter/collector/textfile_test.go:
+//
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// textFileRegistryCollector adapts textFileCollector to prometheus.Collector
+// for registry-level tests, since this package's own Collector interface
+// isn't available in this file.
+type textFileRegistryCollector struct {
+	inner *textFileCollector
+}
+
+func (c textFileRegistryCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c textFileRegistryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.inner.Collect(ch)
+}
+
+// gather registers c against a pedantic registry and returns the gathered
+// families, failing the test if either step errors.
+func gather(t *testing.T, c *textFileCollector) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(textFileRegistryCollector{inner: c}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCollectAggregatesAcrossFiles verifies that a metric family split
+// across two textfiles is merged into a single family with both series,
+// rather than the second file's contribution being skipped.
+func TestCollectAggregatesAcrossFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile-aggregate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "a.prom"), "jobs_total{job=\"a\"} 1\n")
+	writeFile(t, filepath.Join(dir, "b.prom"), "jobs_total{job=\"b\"} 2\n")
+
+	families := gather(t, &textFileCollector{paths: []string{dir}})
+
+	mf, ok := families["jobs_total"]
+	if !ok || len(mf.Metric) != 2 {
+		t.Fatalf("expected 2 aggregated series for jobs_total, got %v", mf)
+	}
+
+	seen := map[string]float64{}
+	for _, m := range mf.Metric {
+		seen[labelValue(m, "job")] = m.GetUntyped().GetValue()
+	}
+	if seen["a"] != 1 || seen["b"] != 2 {
+		t.Fatalf("unexpected aggregated values: %#v", seen)
+	}
+}
+
+// TestCollectReadsGzipTextfile verifies that a .prom.gz file is transparently
+// decompressed and its metric and scrape error are reported like any other
+// textfile.
+func TestCollectReadsGzipTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.prom.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	if _, err := gz.Write([]byte("gzipped_value 42\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	families := gather(t, &textFileCollector{paths: []string{dir}})
+
+	mf, ok := families["gzipped_value"]
+	if !ok || len(mf.Metric) != 1 {
+		t.Fatalf("expected 1 series for gzipped_value, got %v", mf)
+	}
+	if got := mf.Metric[0].GetUntyped().GetValue(); got != 42 {
+		t.Errorf("gzipped_value = %v, want 42", got)
+	}
+
+	scrapeErrors := families["wmi_textfile_scrape_error"]
+	found := false
+	for _, m := range scrapeErrors.Metric {
+		if labelValue(m, "source") == "metrics.prom.gz" {
+			found = true
+			if m.GetGauge().GetValue() != 0 {
+				t.Errorf("wmi_textfile_scrape_error{source=%q} = %v, want 0", "metrics.prom.gz", m.GetGauge().GetValue())
+			}
+		}
+	}
+	if !found {
+		t.Errorf("wmi_textfile_scrape_error{source=%q} not reported", "metrics.prom.gz")
+	}
+}
+
+// TestCollectMarksStaleFilesPastMaxAge verifies that a textfile whose mtime
+// is older than collector.textfile.max-age has its metrics suppressed while
+// still reporting its mtime and a wmi_textfile_scrape_error value of 2.
+func TestCollectMarksStaleFilesPastMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile-stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stale.prom")
+	writeFile(t, path, "stale_value 1\n")
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, &textFileCollector{paths: []string{dir}, maxAge: time.Minute})
+
+	if mf, ok := families["stale_value"]; ok {
+		t.Fatalf("expected stale_value to be suppressed, got %v", mf)
+	}
+
+	mtimeFamily, ok := families["wmi_textfile_mtime_seconds"]
+	if !ok {
+		t.Fatal("wmi_textfile_mtime_seconds not reported for stale file")
+	}
+	var gotMtime float64
+	for _, m := range mtimeFamily.Metric {
+		if labelValue(m, "source") == "stale.prom" {
+			gotMtime = m.GetGauge().GetValue()
+		}
+	}
+	if gotMtime != float64(old.Unix()) {
+		t.Errorf("wmi_textfile_mtime_seconds{source=%q} = %v, want %v", "stale.prom", gotMtime, old.Unix())
+	}
+
+	scrapeErrors, ok := families["wmi_textfile_scrape_error"]
+	if !ok {
+		t.Fatal("wmi_textfile_scrape_error not reported")
+	}
+	var gotError float64 = -1
+	for _, m := range scrapeErrors.Metric {
+		if labelValue(m, "source") == "stale.prom" {
+			gotError = m.GetGauge().GetValue()
+		}
+	}
+	if gotError != 2 {
+		t.Errorf("wmi_textfile_scrape_error{source=%q} = %v, want 2", "stale.prom", gotError)
+	}
+}
+
+// TestCollectFileAndURLScrapeErrorsShareLabelDimensions is a regression test
+// for wmi_textfile_scrape_error being reported through two Descs with
+// different label names ("file" vs "source") once both a textfile directory
+// and a collector.textfile.url source were configured: registry.Gather
+// rejected that as inconsistent label dimensions, which took the whole
+// scrape down. A pedantic registry's Gather must succeed with both sources
+// configured, and every row must share the same "source" label.
+func TestCollectFileAndURLScrapeErrorsShareLabelDimensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "local.prom"), "local_value 1\n")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte("remote_value 2\n"))
+	}))
+	defer srv.Close()
+
+	families := gather(t, &textFileCollector{
+		paths:      []string{dir},
+		urls:       []string{srv.URL},
+		httpClient: srv.Client(),
+	})
+
+	mf, ok := families["wmi_textfile_scrape_error"]
+	if !ok {
+		t.Fatal("wmi_textfile_scrape_error not reported")
+	}
+
+	var sources []string
+	for _, m := range mf.Metric {
+		sources = append(sources, labelValue(m, "source"))
+	}
+	sort.Strings(sources)
+	want := []string{"", "local.prom", srv.URL}
+	sort.Strings(want)
+
+	if len(sources) != len(want) {
+		t.Fatalf("wmi_textfile_scrape_error sources = %v, want %v", sources, want)
+	}
+	for i := range want {
+		if sources[i] != want[i] {
+			t.Fatalf("wmi_textfile_scrape_error sources = %v, want %v", sources, want)
+		}
+	}
+}